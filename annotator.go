@@ -1,258 +1,563 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
 	"sort"
 	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/csrwng/manifest-annotator/internal/yamledit"
 )
 
 type manifestAnnotator struct {
-	FileName       string
+	FileNames      []string
 	Annotation     string
 	SkipAnnotation string
 	Value          string
 
+	Annotations     []string
+	AnnotationsFile string
+	ValueFromEnv    string
+
+	ExpansionFile string
+	ForceExpand   bool
+
+	Remove    bool
+	IfAbsent  bool
+	IfPresent bool
+
+	Target   string
+	Selector string
+
+	DryRun    bool
+	OutputDir string
+
 	Kind         string
 	GroupVersion string
 	Name         string
 	Namespace    string
 }
 
+// manifest captures the identifying fields of a single document within a
+// manifest file, as discovered by walking its YAML AST.
 type manifest struct {
-	name      string
-	namespace string
+	kind         string
+	groupVersion string
+	name         string
+	namespace    string
+}
 
-	start int
-	end   int
+// templateData is the set of per-manifest fields an annotation value may
+// reference via {{ .Kind }}, {{ .Name }} and {{ .Namespace }}.
+type templateData struct {
+	Kind      string
+	Name      string
+	Namespace string
 }
 
 func (a *manifestAnnotator) Run() error {
-	lines, err := readLines(a.FileName)
+	if a.IfAbsent && a.IfPresent {
+		return fmt.Errorf("cannot use both --if-absent and --if-present")
+	}
+	if a.Target != "annotations" && a.Target != "labels" {
+		return fmt.Errorf("invalid --target %q, must be \"annotations\" or \"labels\"", a.Target)
+	}
+	templates, err := a.resolveAnnotationTemplates()
 	if err != nil {
 		return err
 	}
-	output := &bytes.Buffer{}
-	currentManifest := []string{}
-	for _, line := range lines {
-		if strings.HasPrefix(line, "---") {
-			a.processManifest(currentManifest, output)
-			currentManifest = []string{}
-		} else {
-			currentManifest = append(currentManifest, line)
-			continue
-		}
-		output.WriteString(line + "\n")
+	templates, err = a.expandAnnotations(templates)
+	if err != nil {
+		return err
 	}
-	changed := a.processManifest(currentManifest, output)
-	if changed {
-		if err = ioutil.WriteFile(a.FileName, output.Bytes(), 0644); err != nil {
-			return err
+
+	files, err := a.resolveInputFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := a.processFile(file, templates); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
 		}
 	}
 	return nil
 }
 
-func (a *manifestAnnotator) processManifest(lines []string, out *bytes.Buffer) bool {
+// resolveInputFiles expands FileNames - which may mix plain files, "-" for
+// stdin, glob patterns and directories - into a concrete, walked list of
+// paths. Directories are walked recursively for *.yaml/*.yml files.
+func (a *manifestAnnotator) resolveInputFiles() ([]string, error) {
+	var result []string
+	for _, name := range a.FileNames {
+		if name == "-" {
+			result = append(result, name)
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && info.IsDir() {
+			err := filepath.Walk(name, func(walked string, fi os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					return nil
+				}
+				if ext := filepath.Ext(walked); ext == ".yaml" || ext == ".yml" {
+					result = append(result, walked)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		matches, err := filepath.Glob(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			result = append(result, name) // let downstream os.Open surface a not-found error
+			continue
+		}
+		result = append(result, matches...)
+	}
+	return result, nil
+}
 
+// processFile reads, annotates and - depending on --dry-run/--output-dir -
+// writes back a single input file (or stdin/stdout when file is "-").
+func (a *manifestAnnotator) processFile(file string, templates map[string]string) error {
+	var original []byte
+	var err error
+	if file == "-" {
+		original, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		original, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	docs, err := yamledit.DecodeAll(bytes.NewReader(original))
+	if err != nil {
+		return err
+	}
 	changed := false
-	// first determine kind and apiVersion
-	var kind, groupVersion string
-	for _, line := range lines {
-		if strings.HasPrefix(line, "kind:") {
-			kind = strings.TrimSpace(strings.TrimPrefix(line, "kind:"))
-			continue
+	for _, doc := range docs {
+		docChanged, err := a.processDocument(doc, templates)
+		if err != nil {
+			return err
 		}
-		if strings.HasPrefix(line, "apiVersion:") {
-			groupVersion = strings.TrimSpace(strings.TrimPrefix(line, "apiVersion:"))
+		if docChanged {
+			changed = true
 		}
 	}
 
-	inMetadata := false
-	metadataLines := []string{}
-	metadataProcessed := false
-	for _, line := range lines {
-		if inMetadata {
-			if !strings.HasPrefix(line, "  ") {
-				changed = a.processMetadata(metadataLines, kind, groupVersion, out)
-				inMetadata = false
-				metadataProcessed = true
-			} else {
-				metadataLines = append(metadataLines, line)
-				continue
-			}
+	if !changed {
+		if file == "-" && !a.DryRun {
+			_, err := os.Stdout.Write(original)
+			return err
 		}
-		if strings.HasPrefix(line, "metadata:") {
-			inMetadata = true
+		if len(a.OutputDir) > 0 && !a.DryRun {
+			return mirrorToOutputDir(file, original, a.OutputDir, file)
 		}
-		out.WriteString(line + "\n")
+		return nil
+	}
+
+	rendered := &bytes.Buffer{}
+	if err := yamledit.Encode(rendered, docs); err != nil {
+		return err
 	}
-	if !metadataProcessed && len(metadataLines) > 0 {
-		changed = a.processMetadata(metadataLines, kind, groupVersion, out)
+
+	switch {
+	case a.DryRun:
+		return writeDiff(file, original, rendered.Bytes(), os.Stdout)
+	case file == "-":
+		_, err := os.Stdout.Write(rendered.Bytes())
+		return err
+	case len(a.OutputDir) > 0:
+		return mirrorToOutputDir(file, rendered.Bytes(), a.OutputDir, "")
+	default:
+		return ioutil.WriteFile(file, rendered.Bytes(), 0644)
 	}
-	return changed
 }
 
-func (a *manifestAnnotator) processMetadata(lines []string, kind, groupVersion string, out *bytes.Buffer) bool {
-	// Determine information about the current manifest
-	changed := false
-	var name, namespace string
-	for _, line := range lines {
-		if strings.HasPrefix(line, "  name:") {
-			name = strings.TrimSpace(strings.TrimPrefix(line, "  name:"))
+// mirrorToOutputDir writes data to file's path rooted under outputDir,
+// creating any missing directories. If preserveModTimeFrom is non-empty,
+// the written file's mtime is set to match it, so unchanged files are not
+// seen as touched.
+func mirrorToOutputDir(file string, data []byte, outputDir, preserveModTimeFrom string) error {
+	dest := filepath.Join(outputDir, file)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dest, data, 0644); err != nil {
+		return err
+	}
+	if len(preserveModTimeFrom) == 0 {
+		return nil
+	}
+	info, err := os.Stat(preserveModTimeFrom)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// resolveAnnotationTemplates merges every source of annotations - the legacy
+// positional ANNOTATION/VALUE pair, repeated --annotation flags, and
+// --annotations-file - into a single key/value-template set to apply
+// atomically to each matched manifest. Values are returned unrendered; they
+// may still contain {{ .Kind }}/{{ .Name }}/{{ .Namespace }} expressions.
+func (a *manifestAnnotator) resolveAnnotationTemplates() (map[string]string, error) {
+	result := map[string]string{}
+	if len(a.AnnotationsFile) > 0 {
+		fileAnnotations, err := readAnnotationsFile(a.AnnotationsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading annotations file: %w", err)
 		}
-		if strings.HasPrefix(line, "  namespace:") {
-			namespace = strings.TrimSpace(strings.TrimPrefix(line, "  namespace:"))
+		for k, v := range fileAnnotations {
+			result[k] = v
 		}
 	}
-	skipProcessing := (len(a.Kind) > 0 && a.Kind != kind) ||
-		(len(a.GroupVersion) > 0 && a.GroupVersion != groupVersion) ||
-		(len(a.Name) > 0 && a.Name != name) ||
-		(len(a.Namespace) > 0 && a.Namespace != namespace)
-
-	if skipProcessing {
-		for _, line := range lines {
-			out.WriteString(line + "\n")
+	for _, kv := range a.Annotations {
+		key, value, err := splitAnnotationFlag(kv)
+		if err != nil {
+			return nil, err
 		}
-		return changed
-	}
-
-	annotationLines := []string{}
-	inAnnotations := false
-	annotationsProcessed := false
-	for _, line := range lines {
-		if inAnnotations {
-			if !strings.HasPrefix(line, "    ") {
-				changed = a.processAnnotations(annotationLines, out)
-				inAnnotations = false
-				annotationsProcessed = true
-			} else {
-				annotationLines = append(annotationLines, line)
-				continue
-			}
+		result[key] = value
+	}
+	if len(a.Annotation) > 0 {
+		value := a.Value
+		if len(a.ValueFromEnv) > 0 {
+			value = os.Getenv(a.ValueFromEnv)
 		}
-		if strings.HasPrefix(line, "  annotations:") {
-			inAnnotations = true
+		result[a.Annotation] = value
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no annotations specified")
+	}
+	return result, nil
+}
+
+// renderAnnotations evaluates each value template against the fields of the
+// manifest currently being processed.
+func (a *manifestAnnotator) renderAnnotations(templates map[string]string, m manifest) (map[string]string, error) {
+	data := templateData{Kind: m.kind, Name: m.name, Namespace: m.namespace}
+	result := make(map[string]string, len(templates))
+	for key, value := range templates {
+		rendered, err := renderValue(value, data)
+		if err != nil {
+			return nil, fmt.Errorf("rendering value for annotation %q: %w", key, err)
 		}
-		out.WriteString(line + "\n")
+		result[key] = rendered
 	}
-	if len(annotationLines) == 0 { // annotations were never found
-		changed = true
-		out.WriteString("  annotations:\n")
+	return result, nil
+}
+
+func renderValue(value string, data templateData) (string, error) {
+	t, err := template.New("value").Parse(value)
+	if err != nil {
+		return "", err
 	}
-	if !annotationsProcessed {
-		changed = a.processAnnotations(annotationLines, out)
+	out := &bytes.Buffer{}
+	if err := t.Execute(out, data); err != nil {
+		return "", err
 	}
-	return changed
+	return out.String(), nil
 }
 
-func (a *manifestAnnotator) processAnnotations(lines []string, out *bytes.Buffer) bool {
-	annotations := parseAnnotations(lines)
-	if !annotations.Includes(a.Annotation) && !annotations.Includes(a.SkipAnnotation) {
-		annotations.Add(a.Annotation, a.Value)
-		annotations.Sort()
-		annotations.Write(out)
-		return true
+func splitAnnotationFlag(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid --annotation value %q, expected key=value", s)
 	}
-	annotations.Write(out)
-	return false
+	return parts[0], parts[1], nil
 }
 
-type annotation struct {
-	key   string
-	lines []string
+func readAnnotationsFile(filePath string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]string{}
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-type annotations []annotation
+// expansionMap maps a single annotation key to the group of sub-annotations
+// it expands into. A sub-annotation with an empty value means "use the
+// value given for the expanded key".
+type expansionMap map[string]map[string]string
 
-func (a annotations) Len() int {
-	return len(a)
+func readExpansionFile(filePath string) (expansionMap, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	result := expansionMap{}
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (a annotations) Less(i, j int) bool {
-	return a[i].key < a[j].key
+// expandAnnotations replaces any key in templates that matches an entry in
+// --expansion-file with its group of sub-annotations. If two groups set the
+// same sub-key to different values, it is treated as a conflict and an
+// error is returned unless --force-expand is set, in which case the last
+// group processed wins.
+func (a *manifestAnnotator) expandAnnotations(templates map[string]string) (map[string]string, error) {
+	if len(a.ExpansionFile) == 0 {
+		return templates, nil
+	}
+	expansions, err := readExpansionFile(a.ExpansionFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading expansion file: %w", err)
+	}
+	result := map[string]string{}
+	for _, key := range sortedKeys(templates) {
+		value := templates[key]
+		group, ok := expansions[key]
+		if !ok {
+			result[key] = value
+			continue
+		}
+		for _, subKey := range sortedKeys(group) {
+			subValue := group[subKey]
+			if len(subValue) == 0 {
+				subValue = value
+			}
+			if existing, ok := result[subKey]; ok && existing != subValue {
+				if !a.ForceExpand {
+					return nil, fmt.Errorf("conflicting values for expanded annotation %q: %q vs %q", subKey, existing, subValue)
+				}
+			}
+			result[subKey] = subValue
+		}
+	}
+	return result, nil
 }
 
-func (a annotations) Swap(i, j int) {
-	tmp := a[i]
-	a[i] = a[j]
-	a[j] = tmp
+// sortedKeys returns m's keys in sorted order, so that map-driven iteration
+// (e.g. --force-expand's last-group-wins conflict resolution) is
+// reproducible across runs instead of depending on Go's randomized map
+// iteration order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-func (a annotations) Sort() {
-	sort.Sort(a)
+// targetPath returns where in the document tree the edited field lives,
+// defaulting to metadata.annotations.
+func (a *manifestAnnotator) targetPath() []string {
+	if a.Target == "labels" {
+		return []string{"metadata", "labels"}
+	}
+	return []string{"metadata", "annotations"}
 }
 
-func (a annotations) Includes(key string) bool {
-	for _, aa := range a {
-		if aa.key == key {
-			return true
+// processDocument applies the resolved annotation changes to a single
+// document, returning whether it was modified. Filtering (kind, name,
+// namespace, groupVersion, selector) and the skip-annotation guard are
+// evaluated directly against the document's AST.
+func (a *manifestAnnotator) processDocument(doc *yamledit.Document, templates map[string]string) (bool, error) {
+	m := manifestInfo(doc)
+
+	if !matchesKind(a.Kind, m.kind) ||
+		(len(a.GroupVersion) > 0 && a.GroupVersion != m.groupVersion) ||
+		!matchesName(a.Name, m.name) ||
+		(len(a.Namespace) > 0 && a.Namespace != m.namespace) {
+		return false, nil
+	}
+
+	if len(a.Selector) > 0 {
+		labels := snapshotEntries(doc.MapEntries("metadata", "labels"))
+		if !matchesSelector(parseSelector(a.Selector), labels) {
+			return false, nil
 		}
 	}
-	return false
-}
 
-func (a annotations) Write(out *bytes.Buffer) {
-	for _, aa := range a {
-		for _, line := range aa.lines {
-			out.WriteString(line + "\n")
+	fieldPath := a.targetPath()
+	if len(a.SkipAnnotation) > 0 && doc.HasMapEntry(fieldPath, a.SkipAnnotation) {
+		return false, nil
+	}
+
+	changes, err := a.renderAnnotations(templates, m)
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for key, value := range changes {
+		switch {
+		case a.Remove:
+			if doc.RemoveMapEntry(fieldPath, key) {
+				changed = true
+			}
+		case a.IfPresent:
+			if doc.HasMapEntry(fieldPath, key) && doc.SetMapEntry(fieldPath, key, value, true) {
+				changed = true
+			}
+		default:
+			if doc.SetMapEntry(fieldPath, key, value, false) {
+				changed = true
+			}
 		}
 	}
+	return changed, nil
 }
 
-func (a *annotations) Add(key, value string) {
-	*a = append(*a, newAnnotation(key, value))
+// matchesKind reports whether kind satisfies filter, which may be a
+// comma-separated list of acceptable kinds. An empty filter matches
+// everything.
+func matchesKind(filter, kind string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, k := range strings.Split(filter, ",") {
+		if strings.TrimSpace(k) == kind {
+			return true
+		}
+	}
+	return false
 }
 
-func newAnnotation(key, value string) annotation {
-	return annotation{
-		key:   key,
-		lines: []string{fmt.Sprintf("    %s: %s", key, value)},
+// matchesName reports whether name satisfies filter, which may contain glob
+// patterns such as "deploy-*". An empty filter matches everything.
+func matchesName(filter, name string) bool {
+	if len(filter) == 0 {
+		return true
 	}
+	matched, err := path.Match(filter, name)
+	return err == nil && matched
 }
 
-func parseAnnotations(lines []string) annotations {
-	var currentAnnotation *annotation
-	result := annotations{}
-	for _, line := range lines {
-		if strings.HasPrefix(line, "      ") {
-			if currentAnnotation != nil {
-				currentAnnotation.lines = append(currentAnnotation.lines, line)
-			}
-			continue
-		}
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) < 2 {
+// selectorRequirement is a single clause of a Kubernetes-style label
+// selector, e.g. "app=foo" or "tier!=db".
+type selectorRequirement struct {
+	key      string
+	value    string
+	operator string // "=", "!=", "exists", "!exists"
+}
+
+// parseSelector parses a comma-separated label selector such as
+// "app=foo,tier!=db,!deprecated".
+func parseSelector(selector string) []selectorRequirement {
+	if len(selector) == 0 {
+		return nil
+	}
+	var requirements []selectorRequirement
+	for _, clause := range strings.Split(selector, ",") {
+		clause = strings.TrimSpace(clause)
+		if len(clause) == 0 {
 			continue
 		}
-		if currentAnnotation != nil {
-			result = append(result, *currentAnnotation)
+		switch {
+		case strings.HasPrefix(clause, "!"):
+			requirements = append(requirements, selectorRequirement{key: strings.TrimPrefix(clause, "!"), operator: "!exists"})
+		case strings.Contains(clause, "!="):
+			kv := strings.SplitN(clause, "!=", 2)
+			requirements = append(requirements, selectorRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), operator: "!="})
+		case strings.Contains(clause, "=="):
+			kv := strings.SplitN(clause, "==", 2)
+			requirements = append(requirements, selectorRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), operator: "="})
+		case strings.Contains(clause, "="):
+			kv := strings.SplitN(clause, "=", 2)
+			requirements = append(requirements, selectorRequirement{key: strings.TrimSpace(kv[0]), value: strings.TrimSpace(kv[1]), operator: "="})
+		default:
+			requirements = append(requirements, selectorRequirement{key: clause, operator: "exists"})
 		}
-		currentAnnotation = &annotation{
-			key:   strings.TrimSpace(parts[0]),
-			lines: []string{line},
+	}
+	return requirements
+}
+
+// matchesSelector reports whether labels satisfies every requirement.
+func matchesSelector(requirements []selectorRequirement, labels annotations) bool {
+	for _, r := range requirements {
+		value, present := labels.Get(r.key)
+		switch r.operator {
+		case "exists":
+			if !present {
+				return false
+			}
+		case "!exists":
+			if present {
+				return false
+			}
+		case "=":
+			if !present || value != r.value {
+				return false
+			}
+		case "!=":
+			if present && value == r.value {
+				return false
+			}
 		}
 	}
-	if currentAnnotation != nil {
-		result = append(result, *currentAnnotation)
+	return true
+}
+
+func manifestInfo(doc *yamledit.Document) manifest {
+	return manifest{
+		kind:         doc.StringField("kind"),
+		groupVersion: doc.StringField("apiVersion"),
+		name:         doc.StringField("metadata", "name"),
+		namespace:    doc.StringField("metadata", "namespace"),
 	}
-	return result
 }
 
-func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// annotation and annotations are a thin, read-only façade over a document's
+// key/value entries, kept so callers (e.g. selector matching) can inspect
+// and sort a snapshot without reaching into the yamledit AST directly.
+type annotation struct {
+	key   string
+	value string
+}
+
+type annotations []annotation
+
+func (a annotations) Len() int           { return len(a) }
+func (a annotations) Less(i, j int) bool { return a[i].key < a[j].key }
+func (a annotations) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func (a annotations) Sort() {
+	sort.Sort(a)
+}
+
+func (a annotations) Includes(key string) bool {
+	_, ok := a.Get(key)
+	return ok
+}
+
+func (a annotations) Get(key string) (string, bool) {
+	for _, aa := range a {
+		if aa.key == key {
+			return aa.value, true
+		}
 	}
-	defer file.Close()
+	return "", false
+}
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+func snapshotEntries(entries map[string]string) annotations {
+	result := make(annotations, 0, len(entries))
+	for k, v := range entries {
+		result = append(result, annotation{key: k, value: v})
 	}
-	return lines, scanner.Err()
+	result.Sort()
+	return result
 }
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/csrwng/manifest-annotator/internal/yamledit"
+)
+
+func decodeOneDoc(t *testing.T, input string) *yamledit.Document {
+	t.Helper()
+	docs, err := yamledit.DecodeAll(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 document, got %d", len(docs))
+	}
+	return docs[0]
+}
+
+func TestProcessDocumentSetsAnnotationByDefault(t *testing.T) {
+	doc := decodeOneDoc(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n")
+	a := &manifestAnnotator{}
+	changed, err := a.processDocument(doc, map[string]string{"team": "{{ .Name }}-owner"})
+	if err != nil {
+		t.Fatalf("processDocument: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected document to be changed")
+	}
+	if got := doc.MapEntries("metadata", "annotations")["team"]; got != "example-owner" {
+		t.Errorf("got %q, want %q", got, "example-owner")
+	}
+}
+
+func TestProcessDocumentIfPresentOnlyUpdatesExisting(t *testing.T) {
+	doc := decodeOneDoc(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  annotations:\n    team: old\n")
+	a := &manifestAnnotator{IfPresent: true}
+	changed, err := a.processDocument(doc, map[string]string{"team": "new", "other": "new"})
+	if err != nil {
+		t.Fatalf("processDocument: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected document to be changed")
+	}
+	entries := doc.MapEntries("metadata", "annotations")
+	if entries["team"] != "new" {
+		t.Errorf("got team=%q, want %q", entries["team"], "new")
+	}
+	if _, ok := entries["other"]; ok {
+		t.Errorf("expected 'other' to be left unset, got %v", entries)
+	}
+}
+
+func TestProcessDocumentRemove(t *testing.T) {
+	doc := decodeOneDoc(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  annotations:\n    team: old\n")
+	a := &manifestAnnotator{Remove: true}
+	changed, err := a.processDocument(doc, map[string]string{"team": ""})
+	if err != nil {
+		t.Fatalf("processDocument: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected document to be changed")
+	}
+	if doc.HasMapEntry([]string{"metadata", "annotations"}, "team") {
+		t.Error("expected 'team' annotation to be removed")
+	}
+}
+
+func writeTempExpansionFile(t *testing.T, content string) string {
+	t.Helper()
+	f, err := os.CreateTemp(t.TempDir(), "expansion-*.yaml")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	return f.Name()
+}
+
+func TestExpandAnnotationsConflictReturnsError(t *testing.T) {
+	expansionFile := writeTempExpansionFile(t, "feature:\n  sub: value-a\n")
+	a := &manifestAnnotator{ExpansionFile: expansionFile}
+	templates := map[string]string{"feature": "ignored"}
+	if _, err := a.expandAnnotations(templates); err != nil {
+		t.Fatalf("expandAnnotations: %v", err)
+	}
+
+	expansionFile = writeTempExpansionFile(t, "a:\n  sub: one\nb:\n  sub: two\n")
+	a = &manifestAnnotator{ExpansionFile: expansionFile}
+	templates = map[string]string{"a": "", "b": ""}
+	if _, err := a.expandAnnotations(templates); err == nil {
+		t.Fatal("expected conflicting sub-annotation values to return an error")
+	}
+}
+
+func TestExpandAnnotationsForceExpandIsDeterministic(t *testing.T) {
+	expansionFile := writeTempExpansionFile(t, "a:\n  sub: one\nb:\n  sub: two\n")
+	a := &manifestAnnotator{ExpansionFile: expansionFile, ForceExpand: true}
+	templates := map[string]string{"a": "", "b": ""}
+
+	first, err := a.expandAnnotations(templates)
+	if err != nil {
+		t.Fatalf("expandAnnotations: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		got, err := a.expandAnnotations(templates)
+		if err != nil {
+			t.Fatalf("expandAnnotations: %v", err)
+		}
+		if got["sub"] != first["sub"] {
+			t.Fatalf("force-expand resolution was nondeterministic: got %q, first run got %q", got["sub"], first["sub"])
+		}
+	}
+	if first["sub"] != "two" {
+		t.Errorf("expected the alphabetically last group (%q) to win, got %q", "b", first["sub"])
+	}
+}
+
+func TestResolveInputFilesExpandsGlobsDirsAndStdin(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"one.yaml", "two.yml", "skip.txt"} {
+		if err := os.WriteFile(dir+"/"+name, []byte("kind: ConfigMap\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	glob := dir + "/*.yaml"
+	a := &manifestAnnotator{FileNames: []string{glob, dir, "-"}}
+	got, err := a.resolveInputFiles()
+	if err != nil {
+		t.Fatalf("resolveInputFiles: %v", err)
+	}
+	want := map[string]int{dir + "/one.yaml": 2, dir + "/two.yml": 1, "-": 1}
+	counts := map[string]int{}
+	for _, f := range got {
+		counts[f]++
+	}
+	for f, n := range want {
+		if counts[f] != n {
+			t.Errorf("resolveInputFiles() included %q %d times, want %d (got %v)", f, counts[f], n, got)
+		}
+	}
+	if counts[dir+"/skip.txt"] != 0 {
+		t.Errorf("expected non-yaml files to be excluded from a directory walk, got %v", got)
+	}
+}
+
+func TestMirrorToOutputDirPreservesModTime(t *testing.T) {
+	srcDir := t.TempDir()
+	outDir := t.TempDir()
+	src := srcDir + "/in.yaml"
+	if err := os.WriteFile(src, []byte("kind: ConfigMap\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := mirrorToOutputDir(src, []byte("kind: ConfigMap\n"), outDir, src); err != nil {
+		t.Fatalf("mirrorToOutputDir: %v", err)
+	}
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	destInfo, err := os.Stat(outDir + src)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if !destInfo.ModTime().Equal(srcInfo.ModTime()) {
+		t.Errorf("mirrored file mtime = %v, want %v", destInfo.ModTime(), srcInfo.ModTime())
+	}
+}
+
+func TestProcessFileDryRunDoesNotWriteToOutputDir(t *testing.T) {
+	t.Run("changed document", func(t *testing.T) {
+		srcDir := t.TempDir()
+		outDir := t.TempDir()
+		file := srcDir + "/in.yaml"
+		if err := os.WriteFile(file, []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		a := &manifestAnnotator{DryRun: true, OutputDir: outDir}
+		if err := a.processFile(file, map[string]string{"team": "infra"}); err != nil {
+			t.Fatalf("processFile: %v", err)
+		}
+		if _, err := os.Stat(outDir + file); !os.IsNotExist(err) {
+			t.Errorf("expected --dry-run to not write to --output-dir, but found %v (err=%v)", outDir+file, err)
+		}
+	})
+
+	t.Run("unchanged document", func(t *testing.T) {
+		srcDir := t.TempDir()
+		outDir := t.TempDir()
+		file := srcDir + "/in.yaml"
+		if err := os.WriteFile(file, []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  annotations:\n    team: infra\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		a := &manifestAnnotator{DryRun: true, OutputDir: outDir}
+		if err := a.processFile(file, map[string]string{"team": "infra"}); err != nil {
+			t.Fatalf("processFile: %v", err)
+		}
+		if _, err := os.Stat(outDir + file); !os.IsNotExist(err) {
+			t.Errorf("expected --dry-run to not write to --output-dir for an unchanged document, but found %v (err=%v)", outDir+file, err)
+		}
+	})
+}
+
+func TestMatchesKind(t *testing.T) {
+	cases := []struct {
+		filter, kind string
+		want         bool
+	}{
+		{"", "ConfigMap", true},
+		{"ConfigMap", "ConfigMap", true},
+		{"ConfigMap", "Secret", false},
+		{"ConfigMap,Secret", "Secret", true},
+		{"ConfigMap, Secret", "Secret", true},
+	}
+	for _, c := range cases {
+		if got := matchesKind(c.filter, c.kind); got != c.want {
+			t.Errorf("matchesKind(%q, %q) = %v, want %v", c.filter, c.kind, got, c.want)
+		}
+	}
+}
+
+func TestMatchesName(t *testing.T) {
+	cases := []struct {
+		filter, name string
+		want         bool
+	}{
+		{"", "anything", true},
+		{"deploy-*", "deploy-frontend", true},
+		{"deploy-*", "service-frontend", false},
+		{"exact", "exact", true},
+	}
+	for _, c := range cases {
+		if got := matchesName(c.filter, c.name); got != c.want {
+			t.Errorf("matchesName(%q, %q) = %v, want %v", c.filter, c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseSelectorAndMatchesSelector(t *testing.T) {
+	requirements := parseSelector("app=foo,tier!=db,!deprecated,present")
+	labels := snapshotEntries(map[string]string{"app": "foo", "tier": "web", "present": "yes"})
+	if !matchesSelector(requirements, labels) {
+		t.Fatal("expected labels to satisfy the selector")
+	}
+
+	labels = snapshotEntries(map[string]string{"app": "bar", "tier": "web", "present": "yes"})
+	if matchesSelector(requirements, labels) {
+		t.Fatal("expected a mismatched app label to fail the selector")
+	}
+
+	labels = snapshotEntries(map[string]string{"app": "foo", "tier": "db", "present": "yes"})
+	if matchesSelector(requirements, labels) {
+		t.Fatal("expected tier=db to be excluded by tier!=db")
+	}
+
+	labels = snapshotEntries(map[string]string{"app": "foo", "tier": "web", "present": "yes", "deprecated": "true"})
+	if matchesSelector(requirements, labels) {
+		t.Fatal("expected the presence of 'deprecated' to fail !deprecated")
+	}
+}
+
+func TestProcessDocumentPropagatesTemplateErrors(t *testing.T) {
+	doc := decodeOneDoc(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n")
+	a := &manifestAnnotator{}
+	_, err := a.processDocument(doc, map[string]string{"bad": "{{ .Bad"})
+	if err == nil {
+		t.Fatal("expected a malformed template to return an error, not be silently skipped")
+	}
+}
+
+func TestResolveAnnotationTemplatesMergesSources(t *testing.T) {
+	a := &manifestAnnotator{
+		Annotation:  "legacy",
+		Value:       "legacy-value",
+		Annotations: []string{"a=1", "b=2"},
+	}
+	got, err := a.resolveAnnotationTemplates()
+	if err != nil {
+		t.Fatalf("resolveAnnotationTemplates: %v", err)
+	}
+	want := map[string]string{"legacy": "legacy-value", "a": "1", "b": "2"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("got[%q] = %q, want %q", k, got[k], v)
+		}
+	}
+}
+
+func TestResolveAnnotationTemplatesValueFromEnv(t *testing.T) {
+	t.Setenv("MANIFEST_ANNOTATOR_TEST_VALUE", "from-env")
+	a := &manifestAnnotator{Annotation: "legacy", Value: "ignored", ValueFromEnv: "MANIFEST_ANNOTATOR_TEST_VALUE"}
+	got, err := a.resolveAnnotationTemplates()
+	if err != nil {
+		t.Fatalf("resolveAnnotationTemplates: %v", err)
+	}
+	if got["legacy"] != "from-env" {
+		t.Errorf("got %q, want %q", got["legacy"], "from-env")
+	}
+}
+
+func TestRunRejectsInvalidTarget(t *testing.T) {
+	file := writeTempManifest(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n")
+	a := &manifestAnnotator{FileNames: []string{file}, Annotation: "team", Value: "infra", Target: "lable"}
+	err := a.Run()
+	if err == nil {
+		t.Fatal("expected an invalid --target value to return an error")
+	}
+}
+
+func TestRunAcceptsValidTargets(t *testing.T) {
+	for _, target := range []string{"annotations", "labels", ""} {
+		file := writeTempManifest(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n")
+		a := &manifestAnnotator{FileNames: []string{file}, Annotation: "team", Value: "infra", Target: target}
+		if target == "" {
+			a.Target = "annotations"
+		}
+		if err := a.Run(); err != nil {
+			t.Errorf("Run() with --target=%q: %v", target, err)
+		}
+	}
+}
+
+func TestResolveAnnotationTemplatesRequiresAtLeastOne(t *testing.T) {
+	a := &manifestAnnotator{}
+	if _, err := a.resolveAnnotationTemplates(); err == nil {
+		t.Fatal("expected an error when no annotations are given")
+	}
+}
+
+func TestSplitAnnotationFlag(t *testing.T) {
+	if _, _, err := splitAnnotationFlag("no-equals-sign"); err == nil {
+		t.Fatal("expected an error for a flag value without '='")
+	}
+	key, value, err := splitAnnotationFlag("a=b=c")
+	if err != nil {
+		t.Fatalf("splitAnnotationFlag: %v", err)
+	}
+	if key != "a" || value != "b=c" {
+		t.Errorf("got (%q, %q), want (%q, %q)", key, value, "a", "b=c")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// diffOp is one line of an edit script: unchanged (' '), removed ('-') or
+// added ('+').
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffLines computes a minimal line-level edit script from a to b using a
+// classic LCS table. It favors simplicity over speed, which is fine for
+// manifest-sized files.
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < n && j < m {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < n; i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < m; j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+	return ops
+}
+
+// writeDiff writes a `diff -u`-style unified diff between before and after
+// to w, labeled with name.
+func writeDiff(name string, before, after []byte, w io.Writer) error {
+	a := splitLines(before)
+	b := splitLines(after)
+	ops := diffLines(a, b)
+
+	// positions[k] is the (old, new) 1-based line number just before ops[k].
+	type position struct{ old, new int }
+	positions := make([]position, len(ops)+1)
+	positions[0] = position{1, 1}
+	for k, op := range ops {
+		p := positions[k]
+		switch op.kind {
+		case ' ':
+			positions[k+1] = position{p.old + 1, p.new + 1}
+		case '-':
+			positions[k+1] = position{p.old + 1, p.new}
+		case '+':
+			positions[k+1] = position{p.old, p.new + 1}
+		}
+	}
+
+	fmt.Fprintf(w, "--- a/%s\n", name)
+	fmt.Fprintf(w, "+++ b/%s\n", name)
+
+	const context = 3
+	i := 0
+	for i < len(ops) {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		start := i
+		for start > 0 && i-start < context && ops[start-1].kind == ' ' {
+			start--
+		}
+		// Pull in later changes whose context would touch this hunk's, as
+		// diff -u does, so that hunks never overlap.
+		end := i
+		for {
+			for end < len(ops) && ops[end].kind != ' ' {
+				end++
+			}
+			gap := end
+			for gap < len(ops) && ops[gap].kind == ' ' {
+				gap++
+			}
+			if gap == len(ops) || gap-end > 2*context {
+				break
+			}
+			end = gap
+		}
+		run := end
+		for run < len(ops) && run-end < context && ops[run].kind == ' ' {
+			run++
+		}
+		writeHunk(w, ops[start:run], positions[start].old, positions[start].new,
+			positions[run].old-positions[start].old, positions[run].new-positions[start].new)
+		i = run
+	}
+	return nil
+}
+
+func writeHunk(w io.Writer, ops []diffOp, oldStart, newStart, oldCount, newCount int) {
+	fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+	for _, op := range ops {
+		fmt.Fprintf(w, "%c%s\n", op.kind, op.text)
+	}
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteDiffNoChanges(t *testing.T) {
+	content := []byte("apiVersion: v1\nkind: ConfigMap\n")
+	out := &bytes.Buffer{}
+	if err := writeDiff("a.yaml", content, content, out); err != nil {
+		t.Fatalf("writeDiff: %v", err)
+	}
+	got := out.String()
+	if strings.Contains(got, "@@") {
+		t.Errorf("expected no hunks for identical input, got:\n%s", got)
+	}
+	if !strings.Contains(got, "--- a/a.yaml") || !strings.Contains(got, "+++ b/a.yaml") {
+		t.Errorf("expected file headers, got:\n%s", got)
+	}
+}
+
+func TestWriteDiffAddedAndRemovedLines(t *testing.T) {
+	before := []byte("a\nb\nc\n")
+	after := []byte("a\nx\nc\n")
+	out := &bytes.Buffer{}
+	if err := writeDiff("f", before, after, out); err != nil {
+		t.Fatalf("writeDiff: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "-b") {
+		t.Errorf("expected removed line 'b', got:\n%s", got)
+	}
+	if !strings.Contains(got, "+x") {
+		t.Errorf("expected added line 'x', got:\n%s", got)
+	}
+}
+
+func TestDiffLinesMinimalEditScript(t *testing.T) {
+	ops := diffLines([]string{"a", "b", "c"}, []string{"a", "c"})
+	var got []diffOp
+	got = append(got, ops...)
+	want := []diffOp{{' ', "a"}, {'-', "b"}, {' ', "c"}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ops[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSplitLines(t *testing.T) {
+	if got := splitLines([]byte("")); got != nil {
+		t.Errorf("expected nil for empty input, got %v", got)
+	}
+	got := splitLines([]byte("a\nb\n"))
+	want := []string{"a", "b"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
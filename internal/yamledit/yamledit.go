@@ -0,0 +1,220 @@
+// Package yamledit edits YAML documents in place while preserving comments,
+// anchors and flow styles, using the gopkg.in/yaml.v3 Node API. Indentation
+// is not preserved: documents are always re-emitted with a two-space indent.
+// It is the backend for manifest-annotator's metadata editing, replacing an
+// earlier line-based parser that could not cope with tabs, flow-style
+// mappings or non-standard indentation.
+package yamledit
+
+import (
+	"bufio"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Document wraps a single YAML document's AST so it can be inspected and
+// mutated without losing its comments, anchors or node styles.
+type Document struct {
+	node *yaml.Node
+}
+
+// DecodeAll reads every YAML document in r, preserving each document's
+// comments and styles. A multi-document stream separated by "---" decodes
+// into one *Document per entry.
+func DecodeAll(r io.Reader) ([]*Document, error) {
+	dec := yaml.NewDecoder(r)
+	var docs []*Document
+	for {
+		var node yaml.Node
+		if err := dec.Decode(&node); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		n := node
+		docs = append(docs, &Document{node: &n})
+	}
+	return docs, nil
+}
+
+// Encode re-emits docs as a multi-document YAML stream, separated by "---",
+// preserving each document's original comments and styles. The output always
+// uses a two-space indent, whatever the input's indentation was.
+func Encode(w io.Writer, docs []*Document) error {
+	bw := bufio.NewWriter(w)
+	enc := yaml.NewEncoder(bw)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if doc.node == nil {
+			continue
+		}
+		if err := enc.Encode(doc.node); err != nil {
+			return err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// root returns the document's top-level mapping node, unwrapping the
+// implicit DocumentNode that yaml.v3 always produces.
+func (d *Document) root() *yaml.Node {
+	n := d.node
+	if n != nil && n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	return n
+}
+
+// StringField returns the scalar value found by walking path from the
+// document root, e.g. StringField("metadata", "name"). It returns "" if any
+// element of path is missing or is not a scalar.
+func (d *Document) StringField(path ...string) string {
+	node := d.root()
+	for _, p := range path {
+		node = mapValue(node, p)
+		if node == nil {
+			return ""
+		}
+	}
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+// MapEntries returns a flat copy of the scalar key/value pairs found in the
+// mapping at path, e.g. MapEntries("metadata", "labels"). It returns an
+// empty, non-nil map if the mapping does not exist.
+func (d *Document) MapEntries(path ...string) map[string]string {
+	result := map[string]string{}
+	node := d.root()
+	for _, p := range path {
+		node = mapValue(node, p)
+		if node == nil {
+			return result
+		}
+	}
+	if node == nil || node.Kind != yaml.MappingNode {
+		return result
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if value.Kind == yaml.ScalarNode {
+			result[key.Value] = value.Value
+		}
+	}
+	return result
+}
+
+// HasMapEntry reports whether the mapping at path contains key.
+func (d *Document) HasMapEntry(path []string, key string) bool {
+	node := d.root()
+	for _, p := range path {
+		node = mapValue(node, p)
+		if node == nil {
+			return false
+		}
+	}
+	return mapValue(node, key) != nil
+}
+
+// SetMapEntry sets key: value in the mapping located at path, creating any
+// missing intermediate mappings. If key is already present, its value is
+// left untouched unless overwrite is true. It returns whether the document
+// was modified.
+func (d *Document) SetMapEntry(path []string, key, value string, overwrite bool) bool {
+	m := d.ensureMapping(path)
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			if !overwrite || m.Content[i+1].Value == value {
+				return false
+			}
+			m.Content[i+1].Value = value
+			m.Content[i+1].Tag = "!!str"
+			m.Content[i+1].Kind = yaml.ScalarNode
+			return true
+		}
+	}
+	m.Content = append(m.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: key, Tag: "!!str"},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: value, Tag: "!!str"},
+	)
+	return true
+}
+
+// RemoveMapEntry deletes key from the mapping at path, returning whether
+// anything was removed. If the mapping becomes empty as a result, it is
+// itself removed from its parent so an emptied "annotations:" or "labels:"
+// block does not linger in the output.
+func (d *Document) RemoveMapEntry(path []string, key string) bool {
+	parent := d.root()
+	for i, p := range path {
+		m := mapValue(parent, p)
+		if m == nil {
+			return false
+		}
+		if i == len(path)-1 {
+			removed := removeKey(m, key)
+			if removed && len(m.Content) == 0 {
+				removeKey(parent, p)
+			}
+			return removed
+		}
+		parent = m
+	}
+	return false
+}
+
+// ensureMapping walks path from the document root, creating empty mapping
+// nodes for any element that does not already exist, and returns the
+// mapping at the end of path.
+func (d *Document) ensureMapping(path []string) *yaml.Node {
+	node := d.root()
+	if node.Kind != yaml.MappingNode {
+		node.Kind = yaml.MappingNode
+		node.Tag = "!!map"
+		node.Content = nil
+	}
+	for _, p := range path {
+		next := mapValue(node, p)
+		if next == nil {
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: p, Tag: "!!str"},
+				next,
+			)
+		}
+		node = next
+	}
+	return node
+}
+
+func mapValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func removeKey(node *yaml.Node, key string) bool {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package yamledit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundTripNoChanges(t *testing.T) {
+	cases := map[string]string{
+		"multi-doc": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: first
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: second
+`,
+		"anchors-and-aliases": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: example
+data:
+  base: &base
+    color: blue
+  extra: *base
+`,
+		"flow-style-metadata": `apiVersion: v1
+kind: ConfigMap
+metadata: {name: example, labels: {app: demo}}
+`,
+		"crlf-line-endings": "apiVersion: v1\r\nkind: ConfigMap\r\nmetadata:\r\n  name: example\r\n",
+		"missing-metadata": `apiVersion: v1
+kind: ConfigMap
+data:
+  key: value
+`,
+		"head-and-line-comments": `# this manifest configures the thing
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: example # the name
+  annotations:
+    existing: true
+`,
+	}
+
+	for name, input := range cases {
+		t.Run(name, func(t *testing.T) {
+			docs, err := DecodeAll(strings.NewReader(input))
+			if err != nil {
+				t.Fatalf("DecodeAll: %v", err)
+			}
+			out := &bytes.Buffer{}
+			if err := Encode(out, docs); err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			normalized := strings.ReplaceAll(input, "\r\n", "\n")
+			if out.String() != normalized {
+				t.Errorf("round trip changed the document.\nwant:\n%s\ngot:\n%s", normalized, out.String())
+			}
+		})
+	}
+}
+
+func TestSetMapEntryPreservesComments(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: example # the name
+  annotations:
+    existing: "true" # do not remove
+`
+	docs, err := DecodeAll(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("expected 1 document, got %d", len(docs))
+	}
+	doc := docs[0]
+	path := []string{"metadata", "annotations"}
+	if !doc.SetMapEntry(path, "added", "value", false) {
+		t.Fatalf("expected SetMapEntry to report a change")
+	}
+
+	out := &bytes.Buffer{}
+	if err := Encode(out, docs); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	got := out.String()
+	if !strings.Contains(got, "# the name") {
+		t.Errorf("expected line comment to survive, got:\n%s", got)
+	}
+	if !strings.Contains(got, "# do not remove") {
+		t.Errorf("expected existing annotation's comment to survive, got:\n%s", got)
+	}
+	if !strings.Contains(got, "added: value") {
+		t.Errorf("expected new annotation to be written, got:\n%s", got)
+	}
+}
+
+func TestRemoveMapEntryPrunesEmptyMapping(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: example
+  annotations:
+    only: key
+`
+	docs, err := DecodeAll(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	doc := docs[0]
+	path := []string{"metadata", "annotations"}
+	if !doc.RemoveMapEntry(path, "only") {
+		t.Fatalf("expected RemoveMapEntry to report a change")
+	}
+
+	out := &bytes.Buffer{}
+	if err := Encode(out, docs); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if strings.Contains(out.String(), "annotations") {
+		t.Errorf("expected emptied annotations block to be pruned, got:\n%s", out.String())
+	}
+}
+
+func TestSetMapEntryCreatesMissingMetadata(t *testing.T) {
+	input := `apiVersion: v1
+kind: ConfigMap
+data:
+  key: value
+`
+	docs, err := DecodeAll(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	doc := docs[0]
+	path := []string{"metadata", "annotations"}
+	if !doc.SetMapEntry(path, "added", "value", false) {
+		t.Fatalf("expected SetMapEntry to report a change")
+	}
+	if doc.StringField("metadata", "annotations") != "" {
+		t.Fatalf("metadata.annotations should be a mapping, not a scalar")
+	}
+	entries := doc.MapEntries("metadata", "annotations")
+	if entries["added"] != "value" {
+		t.Errorf("expected metadata.annotations.added=value, got %v", entries)
+	}
+}
@@ -16,24 +16,102 @@ func main() {
 func newManifestAnnotatorCommand() *cobra.Command {
 	var opts manifestAnnotator
 	cmd := &cobra.Command{
-		Use:   "manifest-annotator FILENAME ANNOTATION VALUE [OPTS]",
+		Use:   "manifest-annotator FILENAME... [ANNOTATION VALUE] [OPTS]",
 		Short: "Add/Update annotations in a yaml manifest file",
 		Long: `Updates a yaml manifest file without changing the file's structure,
-removing comments, etc. Supports files with multiple manifests.`,
+removing comments, etc. Supports files with multiple manifests.
+
+FILENAME may be given more than once, and each one may be a file, a
+directory (walked recursively for *.yaml/*.yml), a glob pattern, or "-" for
+stdin (in which case the result is written to stdout instead of in place).
+
+Annotations can be given as a single positional ANNOTATION VALUE pair, or as
+one or more --annotation key=value flags, or loaded from a file with
+--annotations-file. All forms can be combined and are applied atomically per
+manifest.
+
+By default an annotation is only set if it is not already present. Use
+--if-present to only update annotations that already exist, or --remove to
+delete them instead. Values may reference the matched manifest with
+{{ .Kind }}, {{ .Name }} and {{ .Namespace }} template expressions.
+
+An --expansion-file can map a single user-facing annotation key to a group
+of sub-annotations that are written in its place, e.g. for packaging
+feature toggles as one annotation.
+
+--target selects whether "metadata.annotations" or "metadata.labels" is
+edited. --selector additionally filters manifests by their existing labels,
+regardless of --target.
+
+--dry-run prints a unified diff of the proposed changes instead of writing
+them, and --output-dir mirrors the input tree into a new location instead
+of editing in place.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(args) != 3 {
-				cmd.Usage()
-				return nil
+			fileNames, annotation, value, ok := classifyArgs(args, !legacyFlagsUsed(cmd))
+			if !ok {
+				return cmd.Usage()
 			}
-			opts.FileName = args[0]
-			opts.Annotation = args[1]
-			opts.Value = args[2]
+			opts.FileNames = fileNames
+			opts.Annotation = annotation
+			opts.Value = value
 			return opts.Run()
 		},
 	}
-	cmd.Flags().StringVar(&opts.Name, "name", "", "[optional] Only annotate manifests with this name")
+	cmd.Flags().StringArrayVarP(&opts.Annotations, "annotation", "a", nil, "[optional] Set an annotation as key=value, may be repeated")
+	cmd.Flags().StringVar(&opts.AnnotationsFile, "annotations-file", "", "[optional] Path to a YAML/JSON file of key: value annotations to set")
+	cmd.Flags().BoolVar(&opts.Remove, "remove", false, "[optional] Remove the given annotation(s) instead of setting them")
+	cmd.Flags().BoolVar(&opts.IfAbsent, "if-absent", false, "[optional] Only set an annotation if it is not already present (default)")
+	cmd.Flags().BoolVar(&opts.IfPresent, "if-present", false, "[optional] Only update an annotation if it is already present")
+	cmd.Flags().StringVar(&opts.ValueFromEnv, "value-from-env", "", "[optional] Read the annotation value from this environment variable instead of VALUE")
+	cmd.Flags().StringVar(&opts.ExpansionFile, "expansion-file", "", "[optional] Path to a file mapping an annotation key to a group of sub-annotations to expand it into")
+	cmd.Flags().BoolVar(&opts.ForceExpand, "force-expand", false, "[optional] Apply expanded sub-annotations even if two groups disagree on a value, instead of failing")
+	cmd.Flags().StringVar(&opts.Target, "target", "annotations", "[optional] Field to edit: \"annotations\" or \"labels\"")
+	cmd.Flags().StringVar(&opts.Selector, "selector", "", "[optional] Only annotate manifests whose labels match this selector, e.g. app=foo,tier!=db")
+	cmd.Flags().StringVar(&opts.Name, "name", "", "[optional] Only annotate manifests with this name, supports glob patterns like deploy-*")
 	cmd.Flags().StringVar(&opts.Namespace, "namespace", "", "[optional] Only annotate manifests with this namespace")
-	cmd.Flags().StringVar(&opts.Kind, "kind", "", "[optional] Only annotate manifests with this kind")
+	cmd.Flags().StringVar(&opts.Kind, "kind", "", "[optional] Only annotate manifests with this kind, accepts a comma-separated list")
 	cmd.Flags().StringVar(&opts.GroupVersion, "groupVersion", "", "[optional] Only annotate manifests with this group and version")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "[optional] Print a unified diff of proposed changes instead of writing them")
+	cmd.Flags().StringVar(&opts.OutputDir, "output-dir", "", "[optional] Mirror the input tree into this directory instead of editing in place")
 	return cmd
 }
+
+// legacyFlagNames are the flags that supply an annotation key in their own
+// right. If any of these are set, a 3-argument invocation can no longer be
+// the legacy "FILENAME ANNOTATION VALUE" form, since that would leave no way
+// to pass three file names. Flags that merely modify how an already-supplied
+// key/value is applied (--remove, --if-present, --if-absent,
+// --value-from-env, --expansion-file, --force-expand) don't add a second
+// source of keys, so they must not disable the legacy form.
+var legacyFlagNames = []string{
+	"annotation", "annotations-file",
+}
+
+// legacyFlagsUsed reports whether any flag that supplies its own
+// annotation(s) was set on cmd.
+func legacyFlagsUsed(cmd *cobra.Command) bool {
+	for _, name := range legacyFlagNames {
+		if cmd.Flags().Changed(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyArgs decides whether args is the legacy positional
+// "FILENAME ANNOTATION VALUE" form or the multi-file form, returning the
+// file names to process and, for the legacy form, the single annotation and
+// value to apply. legacyEligible must be false whenever another flag already
+// supplies annotations, so that three plain file names are never
+// misinterpreted as the legacy form. ok is false if args doesn't describe a
+// valid invocation.
+func classifyArgs(args []string, legacyEligible bool) (fileNames []string, annotation, value string, ok bool) {
+	switch {
+	case len(args) == 3 && legacyEligible:
+		return []string{args[0]}, args[1], args[2], true
+	case len(args) >= 1:
+		return args, "", "", true
+	default:
+		return nil, "", "", false
+	}
+}
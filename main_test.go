@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestClassifyArgs(t *testing.T) {
+	cases := []struct {
+		name           string
+		args           []string
+		legacyEligible bool
+		wantFileNames  []string
+		wantAnnotation string
+		wantValue      string
+		wantOK         bool
+	}{
+		{
+			name:           "legacy form when eligible",
+			args:           []string{"a.yaml", "team", "infra"},
+			legacyEligible: true,
+			wantFileNames:  []string{"a.yaml"},
+			wantAnnotation: "team",
+			wantValue:      "infra",
+			wantOK:         true,
+		},
+		{
+			name:           "three files when a flag already supplies annotations",
+			args:           []string{"a.yaml", "b.yaml", "c.yaml"},
+			legacyEligible: false,
+			wantFileNames:  []string{"a.yaml", "b.yaml", "c.yaml"},
+			wantOK:         true,
+		},
+		{
+			name:          "multi-file form for other counts",
+			args:          []string{"a.yaml", "b.yaml"},
+			wantFileNames: []string{"a.yaml", "b.yaml"},
+			wantOK:        true,
+		},
+		{
+			name:   "no args is not ok",
+			args:   nil,
+			wantOK: false,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fileNames, annotation, value, ok := classifyArgs(c.args, c.legacyEligible)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if len(fileNames) != len(c.wantFileNames) {
+				t.Fatalf("fileNames = %v, want %v", fileNames, c.wantFileNames)
+			}
+			for i := range fileNames {
+				if fileNames[i] != c.wantFileNames[i] {
+					t.Errorf("fileNames[%d] = %q, want %q", i, fileNames[i], c.wantFileNames[i])
+				}
+			}
+			if annotation != c.wantAnnotation || value != c.wantValue {
+				t.Errorf("got (%q, %q), want (%q, %q)", annotation, value, c.wantAnnotation, c.wantValue)
+			}
+		})
+	}
+}
+
+func TestLegacyFlagsUsed(t *testing.T) {
+	cmd := newManifestAnnotatorCommand()
+	if legacyFlagsUsed(cmd) {
+		t.Fatal("expected no legacy flags to be used by default")
+	}
+	if err := cmd.Flags().Set("annotation", "a=b"); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if !legacyFlagsUsed(cmd) {
+		t.Fatal("expected --annotation to count as a legacy flag")
+	}
+}
+
+func TestLegacyFlagsUsedIgnoresPureModifiers(t *testing.T) {
+	for _, name := range []string{"remove", "if-present", "if-absent", "value-from-env", "expansion-file", "force-expand"} {
+		cmd := newManifestAnnotatorCommand()
+		value := "true"
+		if name == "value-from-env" || name == "expansion-file" {
+			value = "x"
+		}
+		if err := cmd.Flags().Set(name, value); err != nil {
+			t.Fatalf("Set(%q): %v", name, err)
+		}
+		if legacyFlagsUsed(cmd) {
+			t.Errorf("expected --%s to not disable the legacy positional form", name)
+		}
+	}
+}
+
+// TestLegacyFormWorksWithModifierFlags drives the command end to end to
+// guard against the legacy "FILENAME ANNOTATION VALUE" form being swallowed
+// into FileNames whenever a pure modifier flag like --remove or
+// --if-present is also given.
+func TestLegacyFormWorksWithModifierFlags(t *testing.T) {
+	t.Run("remove", func(t *testing.T) {
+		file := writeTempManifest(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  annotations:\n    team: old\n")
+		cmd := newManifestAnnotatorCommand()
+		cmd.SetArgs([]string{file, "team", "ignored", "--remove"})
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if strings.Contains(string(data), "team:") {
+			t.Errorf("expected 'team' annotation to be removed, got:\n%s", data)
+		}
+	})
+
+	t.Run("if-present", func(t *testing.T) {
+		file := writeTempManifest(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  annotations:\n    team: old\n")
+		cmd := newManifestAnnotatorCommand()
+		cmd.SetArgs([]string{file, "team", "new", "--if-present"})
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !strings.Contains(string(data), "team: new") {
+			t.Errorf("expected 'team' annotation to be updated to 'new', got:\n%s", data)
+		}
+	})
+
+	t.Run("value-from-env", func(t *testing.T) {
+		t.Setenv("MANIFEST_ANNOTATOR_TEST_LEGACY_ENV", "from-env")
+		file := writeTempManifest(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n")
+		cmd := newManifestAnnotatorCommand()
+		cmd.SetArgs([]string{file, "team", "placeholder", "--value-from-env", "MANIFEST_ANNOTATOR_TEST_LEGACY_ENV"})
+		if err := cmd.Execute(); err != nil {
+			t.Fatalf("Execute: %v", err)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+		if !strings.Contains(string(data), "team: from-env") {
+			t.Errorf("expected 'team' annotation to be set from the environment, got:\n%s", data)
+		}
+	})
+}
+
+func writeTempManifest(t *testing.T, content string) string {
+	t.Helper()
+	file := t.TempDir() + "/manifest.yaml"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return file
+}
+